@@ -19,9 +19,21 @@ limitations under the License.
 package gitstore
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type urlType int
@@ -29,40 +41,187 @@ type urlType int
 const (
 	_               = iota
 	httpURL urlType = iota + 1
+	httpsURL
 	sshURL
 	fileURL
 	gitURL
 	rsyncURL
 )
 
-const gitRegex = "((git|ssh|file|rsync|http(s)?)|((\\w+[\\:\\w]+?@)?[\\w\\.]+))(:(//)?)(\\w+[\\:\\w]+?@)?([\\w\\.\\:/\\-~]+)(\\.git)?(/)?"
+// scpLikeRegex matches SCP-style SSH URLs such as "git@host:owner/repo.git",
+// including bare hostnames and IPs (e.g. "git@gitserver:repo.git", a common
+// ~/.ssh/config Host alias). The host group requires at least two characters so
+// that a single-letter Windows drive form such as "C:\path" is never
+// misclassified as an SSH remote.
+var scpLikeRegex = regexp.MustCompile(`^(?:([^@/]+)@)?([A-Za-z0-9_][A-Za-z0-9_.\-]+(?::\d{1,5})?):(/?.+)$`)
+
+// schemeRegex detects the presence of a URL scheme, e.g. "https://" or "git::https://".
+var schemeRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.\-]*://`)
+
+// Errors returned while parsing a repository URL. These are returned wrapped by
+// Validate, so callers that need to distinguish failure modes should use errors.Is.
+var (
+	// ErrInvalidScheme is returned when a URL has a scheme that is not supported.
+	ErrInvalidScheme = errors.New("gitstore: invalid or unsupported URL scheme")
+	// ErrMissingHost is returned when a URL has no discernible host component.
+	ErrMissingHost = errors.New("gitstore: url is missing a host")
+	// ErrEmptyPath is returned when a URL has no repository path component.
+	ErrEmptyPath = errors.New("gitstore: url is missing a repository path")
+	// ErrBasicAuthOverHTTP is returned when username/password (or token) credentials
+	// are supplied for a plain http:// URL without AllowInsecureHTTPAuth set, since
+	// those credentials would otherwise be sent in cleartext.
+	ErrBasicAuthOverHTTP = errors.New("gitstore: refusing to send basic auth credentials over plain http")
+	// ErrMissingHostKeyVerification is returned for an sshURL RepoRef that supplies
+	// none of KnownHostsFile, KnownHosts or HostKeyCallback, and has not explicitly
+	// opted out via InsecureIgnoreHostKey.
+	ErrMissingHostKeyVerification = errors.New("gitstore: ssh host key verification is required; set KnownHostsFile, KnownHosts, HostKeyCallback or InsecureIgnoreHostKey")
+)
+
+// explicitPrefixes lists prefixes that force a particular interpretation of the
+// remainder of the URL instead of letting parseRepoURL infer one. "git::" is
+// stripped only; "gh:" is additionally expanded into a full github.com URL.
+var explicitPrefixes = []string{"git::", "gh:"}
+
+const ghShorthandPrefix = "gh:"
+
+// codecommitHostRegex matches AWS CodeCommit HTTPS hosts, e.g.
+// "git-codecommit.us-east-1.amazonaws.com".
+var codecommitHostRegex = regexp.MustCompile(`^git-codecommit\.[\w-]+\.amazonaws\.com$`)
+
+// TokenProvider identifies the hosting provider a personal access token was issued
+// by, so that RepoRef can translate it into the HTTP basic-auth pair that provider
+// expects.
+type TokenProvider int
+
+const (
+	// TokenProviderGeneric sends the token as both username and password, which
+	// matches most self-hosted and enterprise git servers.
+	TokenProviderGeneric TokenProvider = iota
+	// TokenProviderGitHub sends the token as "x-access-token:<token>".
+	TokenProviderGitHub
+	// TokenProviderGitLab sends the token as "oauth2:<token>".
+	TokenProviderGitLab
+	// TokenProviderBitbucket sends the token as "x-token-auth:<token>".
+	TokenProviderBitbucket
+)
+
+// githubHostRegex and friends recognise the hosted SaaS domains for each provider, so
+// that TokenProvider can be auto-detected from RepoRef.URL when left unset. Self-hosted
+// instances (GHE, GitLab CE, Bitbucket DC) are not matched here; callers that use them
+// should set TokenProvider explicitly.
+var (
+	githubHostRegex    = regexp.MustCompile(`(?i)(^|\.)github\.com$`)
+	gitlabHostRegex    = regexp.MustCompile(`(?i)(^|\.)gitlab\.com$`)
+	bitbucketHostRegex = regexp.MustCompile(`(?i)(^|\.)bitbucket\.org$`)
+)
+
+// detectTokenProvider infers a TokenProvider from a parsed URL's host. It returns
+// TokenProviderGeneric if the host does not match a known SaaS provider.
+func detectTokenProvider(host string) TokenProvider {
+	switch {
+	case githubHostRegex.MatchString(host):
+		return TokenProviderGitHub
+	case gitlabHostRegex.MatchString(host):
+		return TokenProviderGitLab
+	case bitbucketHostRegex.MatchString(host):
+		return TokenProviderBitbucket
+	default:
+		return TokenProviderGeneric
+	}
+}
+
+// tokenBasicAuth translates a personal access token into the HTTP basic-auth
+// username/password pair expected by provider, per each provider's documented PAT
+// usage (GitHub requires a non-empty username, GitLab's oauth2 flow, Bitbucket's
+// x-token-auth convention). The caller needs only "read code" / "read repository"
+// scope on the token for clone access.
+func tokenBasicAuth(provider TokenProvider, token string) (string, string) {
+	switch provider {
+	case TokenProviderGitHub:
+		return "x-access-token", token
+	case TokenProviderGitLab:
+		return "oauth2", token
+	case TokenProviderBitbucket:
+		return "x-token-auth", token
+	default:
+		return token, token
+	}
+}
+
+// ParsedRepoURL holds the individual pieces extracted from a repository URL by
+// parseRepoURL, regardless of which parsing strategy (scheme, SCP-like, or
+// CodeCommit) produced them.
+type ParsedRepoURL struct {
+	Scheme   string // Scheme is the URL scheme, e.g. "https" or "ssh". Empty for SCP-like URLs.
+	User     string // User is the username extracted from the URL, if any.
+	Pass     string // Pass is the password extracted from the URL, if any.
+	Host     string // Host is the server hostname, without port.
+	Port     string // Port is the server port, if explicitly specified.
+	Path     string // Path is the repository path on the host, e.g. "owner/repo.git".
+	RepoName string // RepoName is the base name of Path with any ".git" suffix removed.
+	Owner    string // Owner is the path segment preceding RepoName, if any.
+}
 
 // RepoRef contains all information required to connect to a git repository
 type RepoRef struct {
-	URL        string // URL where the repository is located
-	User       string // User is the username used for user/pass authentication
-	Pass       string // Pass is the password used for user/pass authentication
-	PrivateKey []byte // PrivateKey is the ssh key material used for SSH key-based authentication
-	urlType    urlType
+	URL                  string        // URL where the repository is located
+	User                 string        // User is the username used for user/pass authentication
+	Pass                 string        // Pass is the password used for user/pass authentication
+	Token                string        // Token is a personal access token used in place of User/Pass for HTTP(S) authentication
+	TokenProvider        TokenProvider // TokenProvider identifies how Token should be translated into basic-auth credentials. Auto-detected from URL host if left unset and Token is non-empty.
+	PrivateKey           []byte        // PrivateKey is the ssh key material used for SSH key-based authentication
+	PrivateKeyPassphrase []byte        // PrivateKeyPassphrase decrypts PrivateKey, if it is password-protected
+
+	// KnownHostsFile is a path to an OpenSSH known_hosts file used to verify the
+	// remote's host key, e.g. one mounted from a Kubernetes ConfigMap.
+	KnownHostsFile string
+	// KnownHosts is known_hosts file content supplied inline instead of a path.
+	KnownHosts []byte
+	// HostKeyCallback, if set, takes priority over KnownHostsFile/KnownHosts and is
+	// passed to go-git's ssh.PublicKeys unmodified.
+	HostKeyCallback ssh.HostKeyCallback
+	// InsecureIgnoreHostKey opts out of host key verification entirely. Leave false
+	// unless you understand the MITM risk this carries.
+	InsecureIgnoreHostKey bool
+
+	// AllowInsecureHTTPAuth opts in to sending User/Pass (or a derived token) over a
+	// plain http:// URL. Leave false unless you control the transport (an internal
+	// mirror, a test fixture) and have accepted the cleartext-credential risk.
+	AllowInsecureHTTPAuth bool
+
+	// CABundle is a PEM-encoded certificate bundle used, instead of the system trust
+	// store, to verify the server's certificate for an httpsURL. Useful for GHE,
+	// GitLab self-hosted or Bitbucket DC instances behind an internal CA.
+	CABundle []byte
+	// ClientCert and ClientKey are a PEM-encoded certificate/key pair presented for
+	// mutual TLS, if the remote requires client certificate authentication.
+	ClientCert []byte
+	ClientKey  []byte
+	// InsecureSkipTLSVerify disables server certificate verification entirely. Leave
+	// false unless you understand the MITM risk this carries.
+	InsecureSkipTLSVerify bool
+
+	urlType urlType
+	parsed  *ParsedRepoURL
+}
+
+// ParsedURL returns the parsed representation of RepoRef.URL, as computed by the
+// most recent call to Validate. It returns nil if Validate has not been called, or
+// returned an error.
+func (r *RepoRef) ParsedURL() *ParsedRepoURL {
+	return r.parsed
 }
 
 // Validate validates the repository url format.
 // If the url contains auth credentials and none are provided explicitly, the relevant fields of the RepoRef are filled.
 func (r *RepoRef) Validate() error {
-	// Does the URL pass basic validation
-	valid, err := validGitURL(r.URL)
+	parsed, err := parseRepoURL(r.URL)
 	if err != nil {
-		return fmt.Errorf("unable to validate URL: %v", err)
-	}
-	if !valid {
-		return fmt.Errorf("invalid git url: %s", r.URL)
+		return fmt.Errorf("invalid git url: %w", err)
 	}
+	r.parsed = parsed
 
-	// Extract repository type, user and password from URL
-	repoType, user, pass, err := getRepoTypeAndUser(r.URL)
-	if err != nil {
-		return fmt.Errorf("unable to determine repository type: %v", err)
-	}
+	repoType, user, pass := urlTypeAndUser(parsed)
 	r.urlType = repoType
 	if r.User == "" {
 		r.User = user
@@ -70,105 +229,267 @@ func (r *RepoRef) Validate() error {
 	if r.Pass == "" {
 		r.Pass = pass
 	}
-	err = validateAuthCredentials(r)
-	if err != nil {
-		return fmt.Errorf("invalid auth credentials: %v", err)
+
+	if r.Token != "" {
+		if r.urlType != httpURL && r.urlType != httpsURL {
+			return fmt.Errorf("gitstore: Token is only supported for http(s) urls")
+		}
+		if r.TokenProvider == TokenProviderGeneric {
+			r.TokenProvider = detectTokenProvider(parsed.Host)
+		}
+		r.User, r.Pass = tokenBasicAuth(r.TokenProvider, r.Token)
+	}
+
+	if err := validateAuthCredentials(r); err != nil {
+		return fmt.Errorf("invalid auth credentials: %w", err)
 	}
 	return nil
 }
 
-// validGitURL checks that the input URL passes the basic URL regex
-func validGitURL(url string) (bool, error) {
-	r, err := regexp.Compile(gitRegex)
+// parseRepoURL parses rawURL into a ParsedRepoURL using a layered strategy: first an
+// explicit prefix (git::, gh:), then a URL scheme, then an SCP-like SSH form
+// (user@host:path), falling through net/url.Parse for anything scheme'd.
+func parseRepoURL(rawURL string) (*ParsedRepoURL, error) {
+	remainder := rawURL
+	ghShorthand := false
+	for _, prefix := range explicitPrefixes {
+		if strings.HasPrefix(remainder, prefix) {
+			remainder = strings.TrimPrefix(remainder, prefix)
+			ghShorthand = prefix == ghShorthandPrefix
+			break
+		}
+	}
+
+	var parsed *ParsedRepoURL
+	var err error
+	switch {
+	case schemeRegex.MatchString(remainder):
+		parsed, err = parseSchemeURL(remainder)
+	case scpLikeRegex.MatchString(remainder):
+		parsed, err = parseSCPLikeURL(remainder)
+	case ghShorthand:
+		// "gh:owner/repo" expands to a github.com HTTPS URL.
+		parsed, err = parseSchemeURL("https://github.com/" + remainder)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidScheme, rawURL)
+	}
 	if err != nil {
-		return false, fmt.Errorf("unable to compile regex: %v", err)
+		return nil, err
 	}
-	return r.MatchString(url), nil
+
+	parsed.Path = strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Path == "" {
+		return nil, fmt.Errorf("%w: %q", ErrEmptyPath, rawURL)
+	}
+	parsed.RepoName = strings.TrimSuffix(path.Base(parsed.Path), ".git")
+	if dir := path.Dir(parsed.Path); dir != "." && dir != "/" {
+		parsed.Owner = path.Base(dir)
+	}
+	return parsed, nil
 }
 
-// getRepoTypeAndUser determines what kind of repository is being clones and
-// extracts user/pass information from the string
-func getRepoTypeAndUser(url string) (urlType, string, string, error) {
-	r, err := regexp.Compile(gitRegex)
+// parseSchemeURL parses a URL that has an explicit scheme (http, https, ssh, git,
+// file, rsync) via net/url.Parse.
+func parseSchemeURL(rawURL string) (*ParsedRepoURL, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return 0, "", "", fmt.Errorf("unable to compile regex: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScheme, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "ssh", "git", "file", "rsync":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidScheme, u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" && u.Scheme != "file" {
+		return nil, fmt.Errorf("%w: %q", ErrMissingHost, rawURL)
+	}
+
+	pass, _ := u.User.Password()
+	parsed := &ParsedRepoURL{
+		Scheme: u.Scheme,
+		User:   u.User.Username(),
+		Pass:   pass,
+		Host:   host,
+		Port:   u.Port(),
+		Path:   strings.TrimPrefix(u.Path, "/"),
+	}
+	if codecommitHostRegex.MatchString(host) {
+		parsed.Path = strings.TrimPrefix(u.Path, "/v1/repos/")
+	}
+	return parsed, nil
+}
+
+// parseSCPLikeURL parses an SCP-like SSH URL such as "git@host:owner/repo.git" or
+// "host:owner/repo.git". The caller has already confirmed rawURL matches scpLikeRegex.
+func parseSCPLikeURL(rawURL string) (*ParsedRepoURL, error) {
+	matches := scpLikeRegex.FindStringSubmatch(rawURL)
+	if matches == nil {
+		return nil, fmt.Errorf("%w: %q", ErrMissingHost, rawURL)
 	}
 
-	// Fetch regex groups
-	matches := r.FindStringSubmatch(url)
-	if len(matches) != 12 {
-		return 0, "", "", fmt.Errorf("should have matched 12 capture groups, matched %d", len(matches))
+	hostPort := matches[2]
+	host := hostPort
+	port := ""
+	if idx := strings.LastIndex(hostPort, ":"); idx != -1 {
+		host = hostPort[:idx]
+		port = hostPort[idx+1:]
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("%w: invalid port %q", ErrMissingHost, port)
+		}
 	}
 
-	// Parse username from regex capture groups
-	user, pass := parseUserPassFromMatches(matches)
-	git := "git"
+	return &ParsedRepoURL{
+		User: matches[1],
+		Host: host,
+		Port: port,
+		Path: matches[3],
+	}, nil
+}
+
+// urlTypeAndUser determines the urlType of an already-parsed repository URL and
+// extracts the user/pass to default RepoRef.User/RepoRef.Pass to.
+func urlTypeAndUser(parsed *ParsedRepoURL) (urlType, string, string) {
+	const git = "git"
+	user, pass := parsed.User, parsed.Pass
 
-	// Switch on protocol prefixes
-	switch matches[1] {
+	switch parsed.Scheme {
 	case "ssh":
 		if user == "" {
 			user = git
 		}
-		return sshURL, user, pass, nil
+		return sshURL, user, pass
 	case "http":
-		return httpURL, user, pass, nil
+		return httpURL, user, pass
 	case "https":
-		return httpURL, user, pass, nil
+		return httpsURL, user, pass
 	case "file":
-		return fileURL, user, pass, nil
+		return fileURL, user, pass
 	case "rsync":
-		return rsyncURL, user, pass, nil
+		return rsyncURL, user, pass
 	case git:
 		if user == "" {
 			user = git
 		}
-		return gitURL, user, pass, nil
+		return gitURL, user, pass
 	}
 
-	// SSH only beyond this point
+	// No scheme: must be an SCP-like SSH URL.
 	if user == "" {
 		user = git
 	}
+	return sshURL, user, pass
+}
 
-	// SSH URL with username x@y.com:foo/bar
-	if strings.Contains(matches[0], "@") {
-		return sshURL, user, pass, nil
+// validateAuthCredentials checks that the authentication configuration for the
+// store is correct
+func validateAuthCredentials(ref *RepoRef) error {
+	if ref.urlType == sshURL {
+		if ref.PrivateKey == nil {
+			return fmt.Errorf("PrivateKey is required for ssh auth")
+		}
+		if ref.KnownHostsFile == "" && ref.KnownHosts == nil && ref.HostKeyCallback == nil && !ref.InsecureIgnoreHostKey {
+			return ErrMissingHostKeyVerification
+		}
 	}
+	if (ref.urlType == httpURL || ref.urlType == httpsURL) && ((ref.User == "") != (ref.Pass == "")) {
+		return fmt.Errorf("For HTTP, both username and password are required, or neither")
+	}
+	if ref.urlType == httpURL && ref.User != "" && !ref.AllowInsecureHTTPAuth {
+		return ErrBasicAuthOverHTTP
+	}
+	if ref.urlType == httpsURL {
+		if _, err := ref.HTTPClient(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// SSH URL without username y.com:foo/bar
-	if matches[6] == ":" {
-
-		return sshURL, user, pass, nil
+// resolveHostKeyCallback returns the ssh.HostKeyCallback that a clone of ref should
+// use, per the precedence documented on RepoRef: an explicit HostKeyCallback first,
+// then KnownHosts content, then a KnownHostsFile on disk, and finally (only if
+// InsecureIgnoreHostKey is set) an always-accept callback.
+func resolveHostKeyCallback(ref *RepoRef) (ssh.HostKeyCallback, error) {
+	if ref.HostKeyCallback != nil {
+		return ref.HostKeyCallback, nil
+	}
+	if ref.KnownHosts != nil {
+		return knownHostsCallbackFromBytes(ref.KnownHosts)
+	}
+	if ref.KnownHostsFile != "" {
+		return knownhosts.New(ref.KnownHostsFile)
 	}
-	return 0, user, pass, fmt.Errorf("unable to determine repository type")
+	if ref.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return nil, ErrMissingHostKeyVerification
 }
 
-// parseUserPassFromMatches splits the user:pass@ strings from the regex group
-func parseUserPassFromMatches(matches []string) (string, string) {
-	var userPass string
-	if matches[5] != "" {
-		userPass = strings.TrimRight(matches[5], "@")
+// knownHostsCallbackFromBytes adapts knownhosts.New, which only reads from paths on
+// disk, to work with inline known_hosts content by spilling it to a temp file first.
+func knownHostsCallbackFromBytes(knownHosts []byte) (ssh.HostKeyCallback, error) {
+	f, err := os.CreateTemp("", "gitstore-known-hosts-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create known_hosts temp file: %v", err)
 	}
-	if matches[8] != "" {
-		userPass = strings.TrimRight(matches[8], "@")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(knownHosts); err != nil {
+		return nil, fmt.Errorf("unable to write known_hosts temp file: %v", err)
 	}
+	return knownhosts.New(f.Name())
+}
 
-	if strings.Contains(userPass, ":") {
-		split := strings.Split(userPass, ":")
-		return split[0], split[1]
+// SSHAuth builds the go-git ssh.PublicKeys auth method for ref, decrypting
+// PrivateKey with PrivateKeyPassphrase if supplied and resolving the host key
+// callback per resolveHostKeyCallback. It is only valid for an sshURL RepoRef that
+// has already passed Validate.
+func (r *RepoRef) SSHAuth() (*gitssh.PublicKeys, error) {
+	auth, err := gitssh.NewPublicKeys(r.User, r.PrivateKey, string(r.PrivateKeyPassphrase))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse PrivateKey: %v", err)
 	}
-	return userPass, ""
+	callback, err := resolveHostKeyCallback(r)
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+	return auth, nil
 }
 
-// validateAuthCredentials checks that the authentication configuration for the
-// store is correct
-func validateAuthCredentials(ref *RepoRef) error {
-	if ref.urlType == sshURL && ref.PrivateKey == nil {
-		return fmt.Errorf("PrivateKey is required for ssh auth")
+// HTTPClient builds an *http.Client for an httpsURL RepoRef: a custom RootCAs pool
+// when CABundle is supplied, a client certificate when ClientCert/ClientKey are
+// supplied, and InsecureSkipVerify only when InsecureSkipTLSVerify is explicitly
+// set. Callers install the returned client on a transport scoped to this repo, e.g.
+// via client.InstallProtocol("https", githttp.NewClient(c)) per GitStore instance,
+// so that repos trusting different CAs can coexist in the same process.
+func (r *RepoRef) HTTPClient() (*http.Client, error) {
+	if r.urlType != httpsURL {
+		return nil, fmt.Errorf("gitstore: HTTPClient is only valid for an https:// RepoRef")
 	}
-	if ref.urlType == httpURL && ((ref.User == "") != (ref.Pass == "")) {
-		return fmt.Errorf("For HTTP, both username and password are required, or neither")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: r.InsecureSkipTLSVerify}
+
+	if len(r.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(r.CABundle) {
+			return nil, fmt.Errorf("unable to parse CABundle: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
 	}
-	return nil
+
+	if len(r.ClientCert) > 0 || len(r.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse ClientCert/ClientKey: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
 }